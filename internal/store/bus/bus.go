@@ -0,0 +1,168 @@
+// Package bus lets SSERelayFeatureStore fan flag/segment updates out to
+// streaming backbones beyond the SSE connections relay already serves, for
+// auditing, cross-region replication, or downstream cache invalidation.
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/launchdarkly/go-server-sdk.v4/ldlog"
+	"gopkg.in/launchdarkly/ld-relay.v5/internal/store/metrics"
+)
+
+// DefaultDispatchTimeout bounds how long a sink's worker waits on a single publish before logging
+// a slow-publish warning. It does not abandon the publish: the worker keeps waiting (and
+// re-warns every DefaultDispatchTimeout) until the sink actually returns, since giving up early
+// would let the next queued event start while this one is still in flight, reordering delivery
+// to that sink.
+const DefaultDispatchTimeout = 5 * time.Second
+
+// dispatchQueueSize bounds how many pending publishes a single sink's worker
+// will queue before newer events are dropped (and logged), so a sink that's
+// persistently slower than the flag-update rate can't grow memory without
+// bound.
+const dispatchQueueSize = 256
+
+// EventSink receives relay's native put/patch/delete/ping events, already
+// serialized, for delivery to an external streaming backbone (Redis,
+// NATS, Kafka, etc). Implementations should treat these calls as
+// fire-and-forget from the caller's perspective: Dispatcher already runs
+// each sink on its own worker goroutine with a timeout, so PublishX should
+// simply do the write and return any error for logging.
+type EventSink interface {
+	// Name identifies the sink in logs and metrics, e.g. "redis", "kafka".
+	Name() string
+	PublishPut(channel string, data []byte) error
+	PublishPatch(channel string, data []byte) error
+	PublishDelete(channel string, data []byte) error
+	PublishPing(channel string) error
+	// Close releases any resources held by the sink (connections, etc).
+	Close() error
+}
+
+// Dispatcher fans a single serialized event out to every registered
+// EventSink. Each sink has its own worker goroutine and queue, so a failing
+// or slow sink is isolated and can never block another sink or the SSE
+// publish path that triggered the dispatch - but, unlike spawning a fresh
+// goroutine per event, a single sink's own events are always delivered to it
+// in the order they were dispatched.
+type Dispatcher struct {
+	workers []*sinkWorker
+	timeout time.Duration
+	loggers ldlog.Loggers
+}
+
+// sinkWorker serializes delivery to a single EventSink via its own queue and
+// worker goroutine.
+type sinkWorker struct {
+	sink  EventSink
+	tasks chan func(EventSink) error
+}
+
+// NewDispatcher creates a Dispatcher for the given sinks, starting one
+// worker goroutine per sink. A zero timeout falls back to
+// DefaultDispatchTimeout (see its doc comment for what the timeout actually
+// controls - a slow-publish warning, not abandonment).
+func NewDispatcher(sinks []EventSink, timeout time.Duration, loggers ldlog.Loggers) *Dispatcher {
+	if timeout <= 0 {
+		timeout = DefaultDispatchTimeout
+	}
+	d := &Dispatcher{timeout: timeout, loggers: loggers}
+	for _, sink := range sinks {
+		w := &sinkWorker{sink: sink, tasks: make(chan func(EventSink) error, dispatchQueueSize)}
+		d.workers = append(d.workers, w)
+		go d.runWorker(w)
+	}
+	return d
+}
+
+// DispatchPut fans out a put event to every sink.
+func (d *Dispatcher) DispatchPut(channel string, data []byte) {
+	d.dispatch(func(sink EventSink) error { return sink.PublishPut(channel, data) })
+}
+
+// DispatchPatch fans out a patch (upsert) event to every sink.
+func (d *Dispatcher) DispatchPatch(channel string, data []byte) {
+	d.dispatch(func(sink EventSink) error { return sink.PublishPatch(channel, data) })
+}
+
+// DispatchDelete fans out a delete event to every sink.
+func (d *Dispatcher) DispatchDelete(channel string, data []byte) {
+	d.dispatch(func(sink EventSink) error { return sink.PublishDelete(channel, data) })
+}
+
+// DispatchPing fans out a heartbeat/ping event to every sink.
+func (d *Dispatcher) DispatchPing(channel string) {
+	d.dispatch(func(sink EventSink) error { return sink.PublishPing(channel) })
+}
+
+// dispatch enqueues fn onto every sink's own worker queue and returns immediately; it never
+// blocks the caller on sink I/O. If a sink's queue is full - it's persistently slower than the
+// rate events are being dispatched - the event is dropped for that sink and logged, rather than
+// blocking the SSE publish path or growing the queue without bound.
+func (d *Dispatcher) dispatch(fn func(EventSink) error) {
+	for _, w := range d.workers {
+		select {
+		case w.tasks <- fn:
+		default:
+			metrics.IncBusDroppedEvents(w.sink.Name())
+			d.loggers.Errorf("event sink %s: dispatch queue full, dropping event", w.sink.Name())
+		}
+	}
+}
+
+// runWorker is the single goroutine that serializes every dispatch to w.sink, so events reach a
+// given sink in the same order they were published while staying isolated from the other sinks.
+// Sends are not time-bounded: each one is waited out in full (see invoke).
+func (d *Dispatcher) runWorker(w *sinkWorker) {
+	for fn := range w.tasks {
+		d.invoke(w.sink, fn)
+	}
+}
+
+// invoke runs fn(sink) and waits for it to finish before returning, so runWorker never starts
+// this sink's next queued dispatch while this one is still in flight - that's what keeps
+// delivery to a single sink in order. It still warns (repeatedly, every d.timeout) if fn is
+// taking unusually long, but it never abandons the call: EventSink has no way to cancel an
+// in-flight publish, so abandoning it here would just leak the goroutine anyway while also
+// letting the next event race ahead of it.
+func (d *Dispatcher) invoke(sink EventSink, fn func(EventSink) error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(sink)
+	}()
+
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				d.loggers.Errorf("event sink %s: publish failed: %s", sink.Name(), err)
+			}
+			return
+		case <-timer.C:
+			d.loggers.Warnf("event sink %s: publish has been running for over %s", sink.Name(), d.timeout)
+			timer.Reset(d.timeout)
+		}
+	}
+}
+
+// Close stops every sink's worker and closes the sink, collecting and logging (but not
+// returning) individual errors since callers can't act on a per-sink failure during shutdown
+// anyway.
+func (d *Dispatcher) Close() {
+	var wg sync.WaitGroup
+	for _, w := range d.workers {
+		wg.Add(1)
+		go func(w *sinkWorker) {
+			defer wg.Done()
+			close(w.tasks)
+			if err := w.sink.Close(); err != nil {
+				d.loggers.Errorf("event sink %s: close failed: %s", w.sink.Name(), err)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,161 @@
+package bus
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/launchdarkly/go-server-sdk.v4/ldlog"
+)
+
+// orderingSink records every value it receives, in the order it received them, so tests can
+// confirm a sink's own worker delivers dispatches in the order they were sent.
+type orderingSink struct {
+	mu   sync.Mutex
+	data []string
+}
+
+func (s *orderingSink) Name() string { return "ordering-test-sink" }
+
+func (s *orderingSink) PublishPut(channel string, data []byte) error { return s.record(string(data)) }
+
+func (s *orderingSink) PublishPatch(channel string, data []byte) error {
+	return s.record(string(data))
+}
+
+func (s *orderingSink) PublishDelete(channel string, data []byte) error {
+	return s.record(string(data))
+}
+
+func (s *orderingSink) PublishPing(channel string) error { return s.record("ping") }
+
+func (s *orderingSink) Close() error { return nil }
+
+func (s *orderingSink) record(value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append(s.data, value)
+	return nil
+}
+
+func (s *orderingSink) snapshot() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.data...)
+}
+
+// TestDispatcherPreservesPerSinkOrder dispatches a burst of patches to a single sink and verifies
+// they arrive in the order they were published. Before the per-sink worker queue, each dispatch
+// spawned its own unordered goroutine, so a later patch could reach the sink before an earlier
+// one - silently reordering cross-region replication or cache-invalidation messages downstream.
+func TestDispatcherPreservesPerSinkOrder(t *testing.T) {
+	sink := &orderingSink{}
+	d := NewDispatcher([]EventSink{sink}, time.Second, ldlog.Loggers{})
+	defer d.Close()
+
+	const n = 50
+	want := make([]string, n)
+	for i := 0; i < n; i++ {
+		value := fmt.Sprintf("patch-%d", i)
+		want[i] = value
+		d.DispatchPatch("channel", []byte(value))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := sink.snapshot()
+		if len(got) == n {
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("sink received %v, want %v", got, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d dispatches, got %d: %v", n, len(got), got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// slowSink is an EventSink whose publishes take longer than the dispatcher's timeout, so tests
+// can confirm invoke waits a publish out - rather than abandoning it once the timeout fires -
+// and that no two publishes to the sink ever run concurrently.
+type slowSink struct {
+	mu       sync.Mutex
+	data     []string
+	inFlight int32
+	delay    time.Duration
+	t        *testing.T
+}
+
+func (s *slowSink) Name() string { return "slow-test-sink" }
+
+func (s *slowSink) PublishPut(channel string, data []byte) error { return s.record(string(data)) }
+
+func (s *slowSink) PublishPatch(channel string, data []byte) error {
+	return s.record(string(data))
+}
+
+func (s *slowSink) PublishDelete(channel string, data []byte) error {
+	return s.record(string(data))
+}
+
+func (s *slowSink) PublishPing(channel string) error { return s.record("ping") }
+
+func (s *slowSink) Close() error { return nil }
+
+func (s *slowSink) record(value string) error {
+	if atomic.AddInt32(&s.inFlight, 1) > 1 {
+		s.t.Errorf("two publishes to the same sink ran concurrently")
+	}
+	time.Sleep(s.delay)
+	atomic.AddInt32(&s.inFlight, -1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append(s.data, value)
+	return nil
+}
+
+func (s *slowSink) snapshot() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.data...)
+}
+
+// TestDispatcherWaitsOutASlowSinkWithoutReordering uses a dispatch timeout far shorter than the
+// sink's own publish delay, so every publish in this test crosses the timeout. It verifies the
+// worker still waits for each publish to actually finish (no two ever overlap) and still
+// delivers every event to the sink in order, instead of racing the next queued event in once the
+// timeout fires.
+func TestDispatcherWaitsOutASlowSinkWithoutReordering(t *testing.T) {
+	sink := &slowSink{delay: 150 * time.Millisecond, t: t}
+	d := NewDispatcher([]EventSink{sink}, 20*time.Millisecond, ldlog.Loggers{})
+	defer d.Close()
+
+	const n = 4
+	want := make([]string, n)
+	for i := 0; i < n; i++ {
+		value := fmt.Sprintf("patch-%d", i)
+		want[i] = value
+		d.DispatchPatch("channel", []byte(value))
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got := sink.snapshot()
+		if len(got) == n {
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("sink received %v, want %v", got, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d dispatches past a slow sink, got %d: %v", n, len(got), got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,62 @@
+package bus
+
+import (
+	"context"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// KafkaConfig configures a Kafka EventSink.
+type KafkaConfig struct {
+	// Brokers is the list of seed broker addresses.
+	Brokers []string
+	// Topic is the Kafka topic to publish to; the relay channel name is
+	// carried as the message key so consumers can partition/filter by it.
+	Topic string
+}
+
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaSink creates an EventSink that publishes to a single Kafka topic,
+// keyed by channel.
+func NewKafkaSink(config KafkaConfig) (EventSink, error) {
+	writer := &kafka.Writer{
+		Addr:     kafka.TCP(config.Brokers...),
+		Topic:    config.Topic,
+		Balancer: &kafka.Hash{},
+	}
+	return &kafkaSink{writer: writer}, nil
+}
+
+func (s *kafkaSink) Name() string {
+	return "kafka"
+}
+
+func (s *kafkaSink) PublishPut(channel string, data []byte) error {
+	return s.publish(channel, data)
+}
+
+func (s *kafkaSink) PublishPatch(channel string, data []byte) error {
+	return s.publish(channel, data)
+}
+
+func (s *kafkaSink) PublishDelete(channel string, data []byte) error {
+	return s.publish(channel, data)
+}
+
+func (s *kafkaSink) PublishPing(channel string) error {
+	return s.publish(channel, []byte("ping"))
+}
+
+func (s *kafkaSink) publish(channel string, data []byte) error {
+	return s.writer.WriteMessages(context.Background(), kafka.Message{
+		Key:   []byte(channel),
+		Value: data,
+	})
+}
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,63 @@
+package bus
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSConfig configures a NATS EventSink.
+type NATSConfig struct {
+	// URL is the NATS server URL, e.g. "nats://localhost:4222".
+	URL string
+	// SubjectPrefix is prepended to the relay channel name to form the
+	// NATS subject, e.g. "ld-relay" + "." + channel.
+	SubjectPrefix string
+}
+
+type natsSink struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+// NewNATSSink creates an EventSink that publishes to a NATS subject per
+// channel.
+func NewNATSSink(config NATSConfig) (EventSink, error) {
+	conn, err := nats.Connect(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to NATS: %w", err)
+	}
+	return &natsSink{conn: conn, prefix: config.SubjectPrefix}, nil
+}
+
+func (s *natsSink) Name() string {
+	return "nats"
+}
+
+func (s *natsSink) PublishPut(channel string, data []byte) error {
+	return s.conn.Publish(s.subject(channel), data)
+}
+
+func (s *natsSink) PublishPatch(channel string, data []byte) error {
+	return s.conn.Publish(s.subject(channel), data)
+}
+
+func (s *natsSink) PublishDelete(channel string, data []byte) error {
+	return s.conn.Publish(s.subject(channel), data)
+}
+
+func (s *natsSink) PublishPing(channel string) error {
+	return s.conn.Publish(s.subject(channel), []byte("ping"))
+}
+
+func (s *natsSink) subject(channel string) string {
+	if s.prefix == "" {
+		return channel
+	}
+	return s.prefix + "." + channel
+}
+
+func (s *natsSink) Close() error {
+	s.conn.Close()
+	return nil
+}
@@ -0,0 +1,66 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisConfig configures a Redis Pub/Sub EventSink.
+type RedisConfig struct {
+	// URL is a redis:// or rediss:// connection URL.
+	URL string
+	// ChannelPrefix is prepended to the relay channel name to form the
+	// Redis pub/sub channel, e.g. "ld-relay" + "." + channel.
+	ChannelPrefix string
+}
+
+type redisSink struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisSink creates an EventSink that publishes to Redis Pub/Sub.
+func NewRedisSink(config RedisConfig) (EventSink, error) {
+	opts, err := redis.ParseURL(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	return &redisSink{client: redis.NewClient(opts), prefix: config.ChannelPrefix}, nil
+}
+
+func (s *redisSink) Name() string {
+	return "redis"
+}
+
+func (s *redisSink) PublishPut(channel string, data []byte) error {
+	return s.publish(channel, data)
+}
+
+func (s *redisSink) PublishPatch(channel string, data []byte) error {
+	return s.publish(channel, data)
+}
+
+func (s *redisSink) PublishDelete(channel string, data []byte) error {
+	return s.publish(channel, data)
+}
+
+func (s *redisSink) PublishPing(channel string) error {
+	return s.publish(channel, []byte("ping"))
+}
+
+func (s *redisSink) publish(channel string, data []byte) error {
+	return s.client.Publish(context.Background(), s.topic(channel), data).Err()
+}
+
+func (s *redisSink) topic(channel string) string {
+	if s.prefix == "" {
+		return channel
+	}
+	return s.prefix + "." + channel
+}
+
+func (s *redisSink) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,134 @@
+package store
+
+import "sync"
+
+// ChannelSpec identifies the scopes that a single environment's updates
+// should be published to, beyond its own channel: the LD project it
+// belongs to, any mobile/client-side keys that should see the same stream,
+// and operator-defined tags.
+type ChannelSpec struct {
+	EnvID        string
+	ProjectID    string
+	MobileKey    string
+	ClientSideID string
+	// Tags are additional channel names this environment's updates should
+	// also be published to, e.g. for tag-scoped subscriptions.
+	Tags []string
+}
+
+// ChannelRegistry maps environments to the full set of SSE channel names
+// their updates should be published to, so a single flag/segment update can
+// be published once but reach every channel it's relevant to (its own
+// environment, its project, any mobile/client-side keys, and any tags). It
+// supports adding and removing environments at runtime so relay can pick up
+// config changes (new/removed envs, projects) without a restart.
+type ChannelRegistry struct {
+	mu       sync.RWMutex
+	channels map[string][]string // envID -> channel names
+}
+
+// NewChannelRegistry creates an empty ChannelRegistry.
+func NewChannelRegistry() *ChannelRegistry {
+	return &ChannelRegistry{channels: make(map[string][]string)}
+}
+
+// Register adds or replaces the channel set for spec.EnvID and returns the
+// full, de-duplicated list of channel names updates for that environment
+// should be published to.
+func (r *ChannelRegistry) Register(spec ChannelSpec) []string {
+	channels := channelsForSpec(spec)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channels[spec.EnvID] = channels
+
+	out := make([]string, len(channels))
+	copy(out, channels)
+	return out
+}
+
+// Deregister removes an environment from the registry, e.g. when it's
+// removed from relay's config without a restart.
+func (r *ChannelRegistry) Deregister(envID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.channels, envID)
+}
+
+// Channels returns the channel names currently registered for envID, or an
+// empty (non-nil) slice if it isn't registered.
+func (r *ChannelRegistry) Channels(envID string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	channels := r.channels[envID]
+	out := make([]string, len(channels))
+	copy(out, channels)
+	return out
+}
+
+func channelsForSpec(spec ChannelSpec) []string {
+	seen := make(map[string]bool, 4+len(spec.Tags))
+	var channels []string
+	add := func(channel string) {
+		if channel == "" || seen[channel] {
+			return
+		}
+		seen[channel] = true
+		channels = append(channels, channel)
+	}
+
+	add(EnvChannel(spec.EnvID))
+	add(ProjectChannel(spec.ProjectID))
+	add(MobileKeyChannel(spec.MobileKey))
+	add(ClientSideIDChannel(spec.ClientSideID))
+	for _, tag := range spec.Tags {
+		add(TagChannel(tag))
+	}
+	return channels
+}
+
+// EnvChannel, ProjectChannel, MobileKeyChannel, ClientSideIDChannel and
+// TagChannel build the canonical channel name for each scope, so the
+// registry and the SSE publishers always agree on naming.
+
+// EnvChannel returns the channel name for an environment's own API key. Unlike the other scope
+// channels, this is the raw envID with no prefix: it's the same channel identity relay has always
+// published on for a given API key, and subscribers/handlers that key off the raw key must keep
+// working without a config change.
+func EnvChannel(envID string) string {
+	return envID
+}
+
+// ProjectChannel returns the channel name shared by every environment in a
+// project.
+func ProjectChannel(projectID string) string {
+	if projectID == "" {
+		return ""
+	}
+	return "proj:" + projectID
+}
+
+// MobileKeyChannel returns the channel name for an environment's mobile key.
+func MobileKeyChannel(mobileKey string) string {
+	if mobileKey == "" {
+		return ""
+	}
+	return "mobile:" + mobileKey
+}
+
+// ClientSideIDChannel returns the channel name for an environment's
+// client-side ID.
+func ClientSideIDChannel(clientSideID string) string {
+	if clientSideID == "" {
+		return ""
+	}
+	return "client:" + clientSideID
+}
+
+// TagChannel returns the channel name for an operator-defined tag.
+func TagChannel(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	return "tag:" + tag
+}
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	es "github.com/launchdarkly/eventsource"
+)
+
+// CloudEvents support lets relay's put/patch/delete/ping stream also be
+// consumed as standards-compliant CloudEvents v1.0 JSON, for downstream
+// consumers that want to plug relay into a generic eventing pipeline
+// (Knative, brokers, tracing, etc) instead of parsing our native SSE
+// payloads. A client opts in per-connection with an
+// `Accept: application/cloudevents+json` header or a `?format=cloudevents`
+// query parameter; the streaming handler then subscribes to
+// CloudEventsChannel(channel) instead of the plain channel name.
+//
+// This package only does the publish-side half of that contract: it wraps
+// and publishes events onto CloudEventsChannel(channel), and exposes
+// IsCloudEventsRequest for a handler to decide which channel to subscribe a
+// connection to. The HTTP streaming handler that reads the Accept
+// header/query parameter off an incoming request, calls IsCloudEventsRequest,
+// and subscribes accordingly lives in relay's serving layer, which isn't part
+// of this repo subset - until that wiring lands, CloudEventsChannel traffic
+// has no subscriber to reach.
+const (
+	cloudEventsAcceptHeader    = "application/cloudevents+json"
+	cloudEventsFormatParam     = "cloudevents"
+	cloudEventsSpecVersion     = "1.0"
+	cloudEventsDataContentType = "application/json"
+	cloudEventsChannelSuffix   = ".cloudevents"
+)
+
+// cloudEvents event type names, mirroring the native SSE event names they wrap.
+const (
+	ceTypeFlagPatch  = "com.launchdarkly.flag.patch"
+	ceTypeFlagDelete = "com.launchdarkly.flag.delete"
+	ceTypeFlagsPut   = "com.launchdarkly.flags.put"
+	ceTypePing       = "com.launchdarkly.ping"
+)
+
+// CloudEventsChannel returns the channel name that carries the CloudEvents
+// envelope form of whatever is published on baseChannel.
+func CloudEventsChannel(baseChannel string) string {
+	return baseChannel + cloudEventsChannelSuffix
+}
+
+// plainChannel strips the CloudEvents channel suffix, if present, so code
+// that keys state off the underlying channel (e.g. the replay buffer) sees
+// the same identity regardless of which form a subscriber connected on.
+func plainChannel(channel string) string {
+	return strings.TrimSuffix(channel, cloudEventsChannelSuffix)
+}
+
+// IsCloudEventsRequest reports whether an incoming SSE request (by Accept
+// header and/or format query parameter) has opted into CloudEvents framing.
+// Callers are expected to be the streaming handler that negotiates a
+// connection's channel; see the package doc comment for the current state of
+// that wiring in this repo subset.
+func IsCloudEventsRequest(accept, formatParam string) bool {
+	return accept == cloudEventsAcceptHeader || formatParam == cloudEventsFormatParam
+}
+
+// cloudEvent is the CloudEvents v1.0 JSON envelope used to wrap relay's
+// native events.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Subject         string          `json:"subject,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+// cloudEventWrapper adapts an existing es.Event into its CloudEvents
+// envelope form. Event() is left untouched so the SSE stream name (put,
+// patch, delete, ping) stays compatible with existing consumers.
+type cloudEventWrapper struct {
+	inner   es.Event
+	id      string
+	source  string
+	ceType  string
+	subject string
+}
+
+func (w cloudEventWrapper) Id() string {
+	return w.id
+}
+
+func (w cloudEventWrapper) Event() string {
+	return w.inner.Event()
+}
+
+func (w cloudEventWrapper) Comment() string {
+	return w.inner.Comment()
+}
+
+func (w cloudEventWrapper) Data() string {
+	ce := cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              w.id,
+		Source:          w.source,
+		Type:            w.ceType,
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		DataContentType: cloudEventsDataContentType,
+		Subject:         w.subject,
+	}
+	// pingEvent.Data() is a literal single space, not JSON - it exists only so eventsource
+	// doesn't drop the comment-less heartbeat. That's not valid CloudEvents `data`, so ping
+	// carries no payload at all rather than embedding invalid JSON.
+	if w.ceType != ceTypePing {
+		ce.Data = json.RawMessage(w.inner.Data())
+	}
+	data, err := json.Marshal(ce)
+	if err != nil {
+		// Fall back to the un-enveloped payload rather than dropping the event.
+		return w.inner.Data()
+	}
+	return string(data)
+}
+
+// cloudEventsSource builds the CloudEvents `source` attribute for a relay
+// instance: its hostname plus envHash(apiKey), so events from different
+// environments can be told apart, and events from the same environment but
+// different relay pods can be told apart too, without leaking the key
+// itself. This is deliberately host-specific - unlike envHash alone, it is
+// not meant to be used as a metrics label, since it wouldn't aggregate
+// across pods.
+func cloudEventsSource(apiKey string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "ld-relay"
+	}
+	return host + "/" + envHash(apiKey)
+}
+
+// envHash is a short, non-reversible, per-pod-stable hash of an SDK key, used to identify a
+// LaunchDarkly environment (e.g. as the metrics "env" label) without leaking the key itself.
+// Unlike cloudEventsSource, it never includes the hostname, so every relay pod serving the same
+// environment reports the same value.
+func envHash(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// cloudEventID derives a stable id for a CloudEvents envelope from the event
+// type, subject (flag/segment path) and data, so redelivery of the same
+// put/patch/delete produces the same id.
+func cloudEventID(ceType, subject, data string) string {
+	sum := sha256.Sum256([]byte(ceType + "|" + subject + "|" + data))
+	return hex.EncodeToString(sum[:16])
+}
+
+// wrapCloudEvent wraps event for publication on a CloudEvents channel. When event already carries
+// a numeric replay-buffer id (patch and delete events do, via nextID), that id is reused as-is so
+// a CloudEvents subscriber's Last-Event-ID on reconnect can still be parsed by parseLastEventID
+// and satisfy delta replay, the same as a plain SSE subscriber's. Put and ping events carry no
+// such id, so they fall back to a content hash as before.
+func wrapCloudEvent(event es.Event, source, ceType, subject string) es.Event {
+	id := event.Id()
+	if id == "" {
+		id = cloudEventID(ceType, subject, event.Data())
+	}
+	return cloudEventWrapper{
+		inner:   event,
+		id:      id,
+		source:  source,
+		ceType:  ceType,
+		subject: subject,
+	}
+}
+
+// cloudEventsRepository adapts an es.Repository so its replayed bootstrap
+// event(s) are also delivered in CloudEvents form.
+type cloudEventsRepository struct {
+	inner  es.Repository
+	source string
+}
+
+// Replay allows cloudEventsRepository to act as an SSE repository. Since chunk0-4, a Replay can
+// yield either a full put snapshot or buffered patch/delete deltas depending on the Last-Event-ID
+// it was given, so the CloudEvents type is derived from each replayed event's own SSE event name
+// rather than fixed at registration time.
+func (r cloudEventsRepository) Replay(channel, id string) (out chan es.Event) {
+	out = make(chan es.Event)
+	in := r.inner.Replay(channel, id)
+	go func() {
+		defer close(out)
+		for event := range in {
+			out <- wrapCloudEvent(event, r.source, ceTypeForEventName(event.Event()), "")
+		}
+	}()
+	return
+}
+
+// ceTypeForEventName maps a native SSE event name to its CloudEvents type, so a replayed patch or
+// delete isn't mislabeled as a put.
+func ceTypeForEventName(name string) string {
+	switch name {
+	case "patch":
+		return ceTypeFlagPatch
+	case "delete":
+		return ceTypeFlagDelete
+	case "ping":
+		return ceTypePing
+	default:
+		return ceTypeFlagsPut
+	}
+}
@@ -0,0 +1,133 @@
+// Package metrics instruments the SSE relay publish path with Prometheus
+// metrics, so operators can alert on relay health and scale streaming pods
+// on backpressure. Label names follow a Grafana-ready convention shared by
+// every metric here: env identifies the LaunchDarkly environment (as a
+// stable, non-reversible hash of its SDK key, the same hash that CloudEvents
+// `source` carries after the relay hostname), sdk_kind is which of the three SSE publishers an
+// event went out on ("all", "flags", or "ping"), and event_type is the SSE
+// event name ("put", "patch", "delete", "ping").
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Label names shared across these metrics.
+const (
+	LabelEnv       = "env"
+	LabelSDKKind   = "sdk_kind"
+	LabelEventType = "event_type"
+	LabelChannel   = "channel"
+	// LabelSink identifies a bus.EventSink by its Name(), e.g. "redis", "kafka".
+	LabelSink = "sink"
+)
+
+var (
+	subscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ld_relay",
+		Subsystem: "sse",
+		Name:      "subscribers",
+		Help:      "Number of currently connected SSE subscribers, per channel.",
+	}, []string{LabelEnv, LabelSDKKind, LabelChannel})
+
+	publishLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ld_relay",
+		Subsystem: "sse",
+		Name:      "publish_latency_seconds",
+		Help:      "Time to serialize and hand an event to eventsource's Publish for every subscriber of a channel. This is the cost of the call itself, not end-to-end delivery to a subscriber's connection - eventsource's fan-out to each subscriber's own channel happens independently of this call returning.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{LabelEnv, LabelSDKKind, LabelEventType})
+
+	busDroppedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ld_relay",
+		Subsystem: "bus",
+		Name:      "dropped_events_total",
+		Help:      "Events dropped because a bus.EventSink's dispatch queue was full, most likely because that sink's publishes can't keep up with the rate of flag updates.",
+	}, []string{LabelSink})
+
+	heartbeatDrift = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ld_relay",
+		Subsystem: "sse",
+		Name:      "heartbeat_drift_seconds",
+		Help:      "Difference between a store's configured heartbeat interval and the actual elapsed time since its previous heartbeat.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{LabelEnv})
+)
+
+func init() {
+	prometheus.MustRegister(subscribers, publishLatency, busDroppedEvents, heartbeatDrift)
+	prometheus.MustRegister(&lastInitCollector{
+		desc: prometheus.NewDesc(
+			"ld_relay_sse_seconds_since_last_init",
+			"Seconds since this environment's feature store last received a full Init.",
+			[]string{LabelEnv}, nil,
+		),
+	})
+}
+
+// SetSubscribers records the current number of connected subscribers on channel, published by
+// sdkKind, for env.
+func SetSubscribers(env, sdkKind, channel string, count int) {
+	subscribers.WithLabelValues(env, sdkKind, channel).Set(float64(count))
+}
+
+// ObservePublishLatency records how long it took to serialize and hand an eventType event on
+// sdkKind to eventsource's Publish, for every channel of env. See publishLatency's Help text for
+// exactly what this does and doesn't measure.
+func ObservePublishLatency(env, sdkKind, eventType string, d time.Duration) {
+	publishLatency.WithLabelValues(env, sdkKind, eventType).Observe(d.Seconds())
+}
+
+// IncBusDroppedEvents records an event dropped because sink's dispatch queue was full.
+func IncBusDroppedEvents(sink string) {
+	busDroppedEvents.WithLabelValues(sink).Inc()
+}
+
+// ObserveHeartbeatDrift records drift, the difference between env's configured heartbeat
+// interval and the actual elapsed time since its previous heartbeat.
+func ObserveHeartbeatDrift(env string, drift time.Duration) {
+	heartbeatDrift.WithLabelValues(env).Observe(drift.Seconds())
+}
+
+// lastInitTimes holds, per env, a *int64 of the UnixNano timestamp of that env's last Init. A
+// Collector (rather than a plain Gauge) is used so the reported value reflects elapsed time at
+// scrape time, not just whatever was last Set.
+var lastInitTimes sync.Map
+
+// RecordInit marks env as having just completed a full Init, for the seconds-since-last-init
+// gauge.
+func RecordInit(env string) {
+	nanos := new(int64)
+	atomic.StoreInt64(nanos, time.Now().UnixNano())
+	lastInitTimes.Store(env, nanos)
+}
+
+type lastInitCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c *lastInitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lastInitCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	lastInitTimes.Range(func(key, value interface{}) bool {
+		env := key.(string)
+		nanos := atomic.LoadInt64(value.(*int64))
+		seconds := now.Sub(time.Unix(0, nanos)).Seconds()
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, seconds, env)
+		return true
+	})
+}
+
+// Handler serves the Prometheus /metrics endpoint; callers wire it into relay's HTTP mux.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -2,30 +2,77 @@ package store
 
 import (
 	"encoding/json"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/launchdarkly/go-server-sdk.v4/ldlog"
+	"gopkg.in/launchdarkly/ld-relay.v5/internal/store/bus"
+	"gopkg.in/launchdarkly/ld-relay.v5/internal/store/metrics"
 	"gopkg.in/launchdarkly/ld-relay.v5/logging"
 
 	es "github.com/launchdarkly/eventsource"
 	ld "gopkg.in/launchdarkly/go-server-sdk.v4"
 )
 
+// sequencePersistInterval bounds how often the replay-event sequence counter is flushed to a
+// persistent sequenceStore. Flushing on every Upsert/Delete would add a store round-trip (and a
+// new failure/latency surface) to the hot path of every single flag update; periodic flushing
+// instead means a restart can only lose, at most, sequencePersistInterval's worth of ids, which
+// Last-Event-ID replay already tolerates by falling back to a full put snapshot.
+const sequencePersistInterval = 5 * time.Second
+
+// sdkKind labels for the three SSE publishers, used in metrics and log messages.
+const (
+	sdkKindAll   = "all"
+	sdkKindFlags = "flags"
+	sdkKindPing  = "ping"
+)
+
+// sequenceStore is optionally implemented by a base ld.FeatureStore to persist the monotonic
+// replay-event-id counter across restarts. A persistent store backing relay (Redis, DynamoDB,
+// Consul) can implement this so Last-Event-ID replay keeps working across a relay restart; a
+// store that doesn't implement it just starts the counter back at 0.
+type sequenceStore interface {
+	GetSequence() (uint64, error)
+	SetSequence(uint64) error
+}
+
 // ESPublisher defines an interface for publishing events to eventsource
 type ESPublisher interface {
 	Publish(channels []string, event es.Event)
 	PublishComment(channels []string, text string)
 	Register(channel string, repo es.Repository)
+	// SubscriberCount returns the number of currently connected subscribers on channel, for the
+	// per-channel subscriber-count metric.
+	SubscriberCount(channel string) int
 }
 
 // SSERelayFeatureStore is a feature store that relays updates to eventsource
 type SSERelayFeatureStore struct {
-	store          ld.FeatureStore
-	allPublisher   ESPublisher
-	flagsPublisher ESPublisher
-	pingPublisher  ESPublisher
-	apiKey         string
-	loggers        ldlog.Loggers
+	store             ld.FeatureStore
+	allPublisher      ESPublisher
+	flagsPublisher    ESPublisher
+	pingPublisher     ESPublisher
+	apiKey            string
+	loggers           ldlog.Loggers
+	cloudEventsSource string
+	envHash           string
+	dispatcher        *bus.Dispatcher
+	registry          *ChannelRegistry
+	replayBuffer      *ReplayBuffer
+	seq               uint64
+	seqStore          sequenceStore
+	heartbeatInterval time.Duration
+	lastHeartbeat     time.Time
+}
+
+// metricsEnv is the stable, non-reversible environment identifier used as the "env" label on
+// every metric this store emits. Unlike cloudEventsSource, it never includes the relay pod's
+// hostname, so every pod serving the same environment reports the same value and metrics
+// aggregate correctly across a fleet instead of multiplying cardinality by pod count.
+func (relay *SSERelayFeatureStore) metricsEnv() string {
+	return relay.envHash
 }
 
 type allRepository struct {
@@ -38,21 +85,57 @@ type pingRepository struct {
 	relayStore *SSERelayFeatureStore
 }
 
-// NewSSERelayFeatureStore creates a new feature store that relays different kinds of updates
+// NewSSERelayFeatureStore creates a new feature store that relays different kinds of updates.
+//
+// registry maps this environment (and its project, mobile key, client-side ID, and tags, as
+// given by spec) to the full set of SSE channels its updates should be published to; pass a
+// shared *ChannelRegistry across every environment's store so project- and tag-scoped channels
+// can be published to once per update rather than once per environment. A nil registry gets a
+// fresh, env-only one.
+//
+// eventSinks are additional EventSink destinations (Redis, NATS, Kafka, etc, see the bus
+// package) that every put/patch/delete/ping is also fanned out to, alongside the SSE
+// publishers.
+//
+// replayBufferSize bounds the number of patch/delete events retained per channel for
+// Last-Event-ID replay (see ReplayBuffer); a non-positive value uses DefaultReplayBufferSize.
 func NewSSERelayFeatureStore(apiKey string, allPublisher ESPublisher, flagsPublisher ESPublisher, pingPublisher ESPublisher,
-	baseFeatureStore ld.FeatureStore, loggers ldlog.Loggers, heartbeatInterval int) *SSERelayFeatureStore {
+	baseFeatureStore ld.FeatureStore, loggers ldlog.Loggers, heartbeatInterval int, registry *ChannelRegistry,
+	spec ChannelSpec, replayBufferSize int, eventSinks ...bus.EventSink) *SSERelayFeatureStore {
+	if registry == nil {
+		registry = NewChannelRegistry()
+	}
+
+	var seq uint64
+	var seqStore sequenceStore
+	if ss, ok := baseFeatureStore.(sequenceStore); ok {
+		seqStore = ss
+		if persisted, err := ss.GetSequence(); err != nil {
+			loggers.Warnf("Could not load persisted event sequence, starting from 0: %s", err)
+		} else {
+			seq = persisted
+		}
+	}
+
 	relayStore := &SSERelayFeatureStore{
-		store:          baseFeatureStore,
-		apiKey:         apiKey,
-		allPublisher:   allPublisher,
-		flagsPublisher: flagsPublisher,
-		pingPublisher:  pingPublisher,
-		loggers:        loggers,
+		store:             baseFeatureStore,
+		apiKey:            apiKey,
+		allPublisher:      allPublisher,
+		flagsPublisher:    flagsPublisher,
+		pingPublisher:     pingPublisher,
+		loggers:           loggers,
+		cloudEventsSource: cloudEventsSource(apiKey),
+		envHash:           envHash(apiKey),
+		dispatcher:        bus.NewDispatcher(eventSinks, bus.DefaultDispatchTimeout, loggers),
+		registry:          registry,
+		replayBuffer:      NewReplayBuffer(replayBufferSize),
+		seq:               seq,
+		seqStore:          seqStore,
+		heartbeatInterval: time.Duration(heartbeatInterval) * time.Second,
 	}
 
-	allPublisher.Register(apiKey, allRepository{relayStore: relayStore})
-	flagsPublisher.Register(apiKey, flagsRepository{relayStore: relayStore})
-	pingPublisher.Register(apiKey, pingRepository{relayStore: relayStore})
+	spec.EnvID = apiKey
+	relayStore.registerChannels(registry.Register(spec))
 
 	if heartbeatInterval > 0 {
 		go func() {
@@ -64,14 +147,158 @@ func NewSSERelayFeatureStore(apiKey string, allPublisher ESPublisher, flagsPubli
 		}()
 	}
 
+	if seqStore != nil {
+		go relayStore.persistSequencePeriodically()
+	}
+
 	return relayStore
 }
 
+// Register adds or updates the additional channel scopes (project, mobile key, client-side ID,
+// tags) this environment's updates are published to, without requiring a relay restart. The
+// envID in spec is overwritten with this store's own API key. Any newly-added channels are
+// registered as SSE repositories so new subscribers can bootstrap from them immediately.
+func (relay *SSERelayFeatureStore) Register(spec ChannelSpec) {
+	spec.EnvID = relay.apiKey
+	relay.registerChannels(relay.registry.Register(spec))
+}
+
+// Deregister removes this environment from the channel registry, e.g. when it's removed from
+// relay's config without a restart. Existing SSE connections on its channels are not closed.
+// Connections on its project, mobile key, client-side ID and tag channels stop receiving further
+// updates; its own API-key channel keeps receiving them, since keys() falls back to it.
+func (relay *SSERelayFeatureStore) Deregister() {
+	relay.registry.Deregister(relay.apiKey)
+}
+
+// registerChannels registers SSE repositories (plain and CloudEvents) for every channel in
+// channels. It's safe to call repeatedly, including with channels already registered.
+func (relay *SSERelayFeatureStore) registerChannels(channels []string) {
+	for _, channel := range channels {
+		relay.allPublisher.Register(channel, allRepository{relayStore: relay})
+		relay.flagsPublisher.Register(channel, flagsRepository{relayStore: relay})
+		relay.pingPublisher.Register(channel, pingRepository{relayStore: relay})
+
+		relay.allPublisher.Register(CloudEventsChannel(channel), cloudEventsRepository{
+			inner:  allRepository{relayStore: relay},
+			source: relay.cloudEventsSource,
+		})
+		relay.flagsPublisher.Register(CloudEventsChannel(channel), cloudEventsRepository{
+			inner:  flagsRepository{relayStore: relay},
+			source: relay.cloudEventsSource,
+		})
+		relay.pingPublisher.Register(CloudEventsChannel(channel), cloudEventsRepository{
+			inner:  pingRepository{relayStore: relay},
+			source: relay.cloudEventsSource,
+		})
+	}
+}
+
+// keys returns the full set of SSE channels this environment's updates should be published to,
+// as determined by the ChannelRegistry: its own channel plus any project, mobile key,
+// client-side ID, or tag channels it's registered under.
 func (relay *SSERelayFeatureStore) keys() []string {
+	if channels := relay.registry.Channels(relay.apiKey); len(channels) > 0 {
+		return channels
+	}
 	return []string{relay.apiKey}
 }
 
+// nextID assigns the next monotonic replay-event id. It only increments the in-memory counter;
+// persistSequencePeriodically flushes it to the base feature store (when it implements
+// sequenceStore) on its own schedule rather than on every call, since this runs on the hot path
+// of every single Upsert/Delete.
+func (relay *SSERelayFeatureStore) nextID() uint64 {
+	return atomic.AddUint64(&relay.seq, 1)
+}
+
+// persistSequencePeriodically flushes the in-memory sequence counter to relay.seqStore every
+// sequencePersistInterval, so ids keep incrementing roughly across a relay restart without paying
+// a store round-trip on every flag update. It's a no-op loop (never started) when the base
+// feature store doesn't implement sequenceStore.
+func (relay *SSERelayFeatureStore) persistSequencePeriodically() {
+	var lastPersisted uint64
+	t := time.NewTicker(sequencePersistInterval)
+	defer t.Stop()
+	for range t.C {
+		current := atomic.LoadUint64(&relay.seq)
+		if current == lastPersisted {
+			continue
+		}
+		if err := relay.seqStore.SetSequence(current); err != nil {
+			relay.loggers.Warnf("Could not persist event sequence: %s", err)
+			continue
+		}
+		lastPersisted = current
+	}
+}
+
+// allBufferKey and flagsBufferKey key the replay buffer per publisher, since the allPublisher
+// and flagsPublisher channel namespaces are independent even when they share a channel name.
+func allBufferKey(channel string) string {
+	return "all:" + plainChannel(channel)
+}
+
+func flagsBufferKey(channel string) string {
+	return "flags:" + plainChannel(channel)
+}
+
+// publishEvent publishes event, sent on sdkKind's publisher, on the plain channels returned by
+// keys(), and again in CloudEvents envelope form on their CloudEventsChannel counterparts, so
+// connections that negotiated CloudEvents framing still see every update. It also serializes
+// event once and dispatches it to every registered bus.EventSink, so a slow or unreachable
+// external broker can never hold up the SSE path, and records per-channel subscriber counts.
+//
+// It times the call to publisher.Publish and records that as publish latency. eventsource's
+// Publish fans out to each subscriber's own channel and returns once that fan-out is queued, not
+// once a subscriber has actually received anything, so this measures the cost of serializing and
+// handing an event off, not end-to-end delivery to a slow subscriber's connection - eventsource
+// doesn't expose per-subscriber send status, so that finer-grained metric isn't available here.
+// The bus dispatch path, by contrast, drops an event outright when a sink's queue is full (see
+// bus.Dispatcher.dispatch), which is directly measurable and counted via metrics.IncBusDroppedEvents.
+func (relay *SSERelayFeatureStore) publishEvent(publisher ESPublisher, sdkKind string, event es.Event, ceType, subject string) {
+	channels := relay.keys()
+	eventType := event.Event()
+	env := relay.metricsEnv()
+
+	start := time.Now()
+	publisher.Publish(channels, event)
+	metrics.ObservePublishLatency(env, sdkKind, eventType, time.Since(start))
+
+	for _, channel := range channels {
+		metrics.SetSubscribers(env, sdkKind, channel, publisher.SubscriberCount(channel))
+	}
+
+	ceChannels := make([]string, len(channels))
+	for i, channel := range channels {
+		ceChannels[i] = CloudEventsChannel(channel)
+	}
+	publisher.Publish(ceChannels, wrapCloudEvent(event, relay.cloudEventsSource, ceType, subject))
+
+	data := []byte(event.Data())
+	for _, channel := range channels {
+		switch eventType {
+		case "put":
+			relay.dispatcher.DispatchPut(channel, data)
+		case "patch":
+			relay.dispatcher.DispatchPatch(channel, data)
+		case "delete":
+			relay.dispatcher.DispatchDelete(channel, data)
+		case "ping":
+			relay.dispatcher.DispatchPing(channel)
+		}
+	}
+}
+
 func (relay *SSERelayFeatureStore) heartbeat() {
+	now := time.Now()
+	// The first heartbeat has no previous one to measure drift against.
+	if !relay.lastHeartbeat.IsZero() {
+		drift := now.Sub(relay.lastHeartbeat) - relay.heartbeatInterval
+		metrics.ObserveHeartbeatDrift(relay.metricsEnv(), drift)
+	}
+	relay.lastHeartbeat = now
+
 	relay.allPublisher.PublishComment(relay.keys(), "")
 	relay.flagsPublisher.PublishComment(relay.keys(), "")
 	relay.pingPublisher.PublishComment(relay.keys(), "")
@@ -96,9 +323,10 @@ func (relay *SSERelayFeatureStore) Init(allData map[ld.VersionedDataKind]map[str
 		return err
 	}
 
-	relay.allPublisher.Publish(relay.keys(), makePutEvent(allData[ld.Features], allData[ld.Segments]))
-	relay.flagsPublisher.Publish(relay.keys(), makeFlagsPutEvent(allData[ld.Features]))
-	relay.pingPublisher.Publish(relay.keys(), makePingEvent())
+	metrics.RecordInit(relay.metricsEnv())
+	relay.publishEvent(relay.allPublisher, sdkKindAll, makePutEvent(allData[ld.Features], allData[ld.Segments]), ceTypeFlagsPut, "")
+	relay.publishEvent(relay.flagsPublisher, sdkKindFlags, makeFlagsPutEvent(allData[ld.Features]), ceTypeFlagsPut, "")
+	relay.publishEvent(relay.pingPublisher, sdkKindPing, makePingEvent(), ceTypePing, "")
 
 	return nil
 }
@@ -112,11 +340,24 @@ func (relay *SSERelayFeatureStore) Delete(kind ld.VersionedDataKind, key string,
 	}
 
 	relay.loggers.Debugf(`Feature flag %s was deleted (version %d)`, key, version)
-	relay.allPublisher.Publish(relay.keys(), makeDeleteEvent(kind, key, version))
+	id := relay.nextID()
+	idStr := strconv.FormatUint(id, 10)
+
+	path := "/" + dataKindApiName[kind] + "/" + key
+	allEvent := makeDeleteEvent(kind, key, version, idStr)
+	relay.publishEvent(relay.allPublisher, sdkKindAll, allEvent, ceTypeFlagDelete, path)
+	for _, channel := range relay.keys() {
+		relay.replayBuffer.Add(allBufferKey(channel), id, allEvent)
+	}
+
 	if kind == ld.Features {
-		relay.flagsPublisher.Publish(relay.keys(), makeFlagsDeleteEvent(key, version))
+		flagsEvent := makeFlagsDeleteEvent(key, version, idStr)
+		relay.publishEvent(relay.flagsPublisher, sdkKindFlags, flagsEvent, ceTypeFlagDelete, "/"+key)
+		for _, channel := range relay.keys() {
+			relay.replayBuffer.Add(flagsBufferKey(channel), id, flagsEvent)
+		}
 	}
-	relay.pingPublisher.Publish(relay.keys(), makePingEvent())
+	relay.publishEvent(relay.pingPublisher, sdkKindPing, makePingEvent(), ceTypePing, "")
 
 	return nil
 }
@@ -138,11 +379,24 @@ func (relay *SSERelayFeatureStore) Upsert(kind ld.VersionedDataKind, item ld.Ver
 
 	if newItem != nil {
 		relay.loggers.Debugf(`allPublisher publish event with: %s (version %d)`, newItem.GetKey(), newItem.GetVersion())
-		relay.allPublisher.Publish(relay.keys(), makeUpsertEvent(kind, newItem))
+		id := relay.nextID()
+		idStr := strconv.FormatUint(id, 10)
+
+		path := "/" + dataKindApiName[kind] + "/" + newItem.GetKey()
+		allEvent := makeUpsertEvent(kind, newItem, idStr)
+		relay.publishEvent(relay.allPublisher, sdkKindAll, allEvent, ceTypeFlagPatch, path)
+		for _, channel := range relay.keys() {
+			relay.replayBuffer.Add(allBufferKey(channel), id, allEvent)
+		}
+
 		if kind == ld.Features {
-			relay.flagsPublisher.Publish(relay.keys(), makeFlagsUpsertEvent(newItem))
+			flagsEvent := makeFlagsUpsertEvent(newItem, idStr)
+			relay.publishEvent(relay.flagsPublisher, sdkKindFlags, flagsEvent, ceTypeFlagPatch, "/"+newItem.GetKey())
+			for _, channel := range relay.keys() {
+				relay.replayBuffer.Add(flagsBufferKey(channel), id, flagsEvent)
+			}
 		}
-		relay.pingPublisher.Publish(relay.keys(), makePingEvent())
+		relay.publishEvent(relay.pingPublisher, sdkKindPing, makePingEvent(), ceTypePing, "")
 	}
 
 	return nil
@@ -153,48 +407,86 @@ func (relay *SSERelayFeatureStore) Initialized() bool {
 	return relay.store.Initialized()
 }
 
-// Replay allows the feature store to act as an SSE repository (to send bootstrap events)
+// Replay allows the feature store to act as an SSE repository (to send bootstrap events). If id
+// is a Last-Event-ID still covered by the replay buffer, only the patch/delete events since it
+// are replayed; otherwise (no id, unknown id, or an id older than the buffer's tail) a full put
+// snapshot is sent instead.
 func (r flagsRepository) Replay(channel, id string) (out chan es.Event) {
 	out = make(chan es.Event)
 	go func() {
 		defer close(out)
-		if r.relayStore.Initialized() {
-			flags, err := r.relayStore.All(ld.Features)
+		if !r.relayStore.Initialized() {
+			return
+		}
 
-			if err != nil {
-				logging.GlobalLoggers.Errorf("Error getting all flags: %s\n", err.Error())
-			} else {
-				out <- makeFlagsPutEvent(flags)
+		if lastID, ok := parseLastEventID(id); ok {
+			if events, ok := r.relayStore.replayBuffer.Since(flagsBufferKey(channel), lastID); ok {
+				for _, event := range events {
+					out <- event
+				}
+				return
 			}
 		}
+
+		flags, err := r.relayStore.All(ld.Features)
+
+		if err != nil {
+			logging.GlobalLoggers.Errorf("Error getting all flags: %s\n", err.Error())
+		} else {
+			out <- makeFlagsPutEvent(flags)
+		}
 	}()
 	return
 }
 
-// Replay allows the feature store to act as an SSE repository (to send bootstrap events)
+// Replay allows the feature store to act as an SSE repository (to send bootstrap events). See
+// flagsRepository.Replay for the Last-Event-ID replay/fallback behavior.
 func (r allRepository) Replay(channel, id string) (out chan es.Event) {
 	out = make(chan es.Event)
 	go func() {
 		defer close(out)
-		if r.relayStore.Initialized() {
-			flags, err := r.relayStore.All(ld.Features)
+		if !r.relayStore.Initialized() {
+			return
+		}
 
-			if err != nil {
-				logging.GlobalLoggers.Errorf("Error getting all flags: %s\n", err.Error())
-			} else {
-				segments, err := r.relayStore.All(ld.Segments)
-				if err != nil {
-					logging.GlobalLoggers.Errorf("Error getting all segments: %s\n", err.Error())
-				} else {
-					out <- makePutEvent(flags, segments)
+		if lastID, ok := parseLastEventID(id); ok {
+			if events, ok := r.relayStore.replayBuffer.Since(allBufferKey(channel), lastID); ok {
+				for _, event := range events {
+					out <- event
 				}
+				return
 			}
+		}
+
+		flags, err := r.relayStore.All(ld.Features)
 
+		if err != nil {
+			logging.GlobalLoggers.Errorf("Error getting all flags: %s\n", err.Error())
+		} else {
+			segments, err := r.relayStore.All(ld.Segments)
+			if err != nil {
+				logging.GlobalLoggers.Errorf("Error getting all segments: %s\n", err.Error())
+			} else {
+				out <- makePutEvent(flags, segments)
+			}
 		}
 	}()
 	return
 }
 
+// parseLastEventID parses a Last-Event-ID header value as assigned by nextID, reporting ok=false
+// for an empty or non-numeric id (e.g. a client connecting for the first time).
+func parseLastEventID(id string) (uint64, bool) {
+	if id == "" {
+		return 0, false
+	}
+	parsed, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return parsed, true
+}
+
 // Replay allows the feature store to act as an SSE repository (to send bootstrap events)
 func (r pingRepository) Replay(channel, id string) (out chan es.Event) {
 	out = make(chan es.Event)
@@ -217,11 +509,13 @@ type allPutEvent struct {
 type deleteEvent struct {
 	Path    string `json:"path"`
 	Version int    `json:"version"`
+	id      string
 }
 
 type upsertEvent struct {
 	Path string           `json:"path"`
 	D    ld.VersionedData `json:"data"`
+	id   string
 }
 
 type pingEvent struct{}
@@ -263,7 +557,7 @@ func (t allPutEvent) Comment() string {
 }
 
 func (t upsertEvent) Id() string {
-	return ""
+	return t.id
 }
 
 func (t upsertEvent) Event() string {
@@ -281,7 +575,7 @@ func (t upsertEvent) Comment() string {
 }
 
 func (t deleteEvent) Id() string {
-	return ""
+	return t.id
 }
 
 func (t deleteEvent) Event() string {
@@ -314,31 +608,35 @@ func (t pingEvent) Comment() string {
 	return ""
 }
 
-func makeUpsertEvent(kind ld.VersionedDataKind, item ld.VersionedData) es.Event {
+func makeUpsertEvent(kind ld.VersionedDataKind, item ld.VersionedData, id string) es.Event {
 	return upsertEvent{
 		Path: "/" + dataKindApiName[kind] + "/" + item.GetKey(),
 		D:    item,
+		id:   id,
 	}
 }
 
-func makeFlagsUpsertEvent(item ld.VersionedData) es.Event {
+func makeFlagsUpsertEvent(item ld.VersionedData, id string) es.Event {
 	return upsertEvent{
 		Path: "/" + item.GetKey(),
 		D:    item,
+		id:   id,
 	}
 }
 
-func makeDeleteEvent(kind ld.VersionedDataKind, key string, version int) es.Event {
+func makeDeleteEvent(kind ld.VersionedDataKind, key string, version int, id string) es.Event {
 	return deleteEvent{
 		Path:    "/" + dataKindApiName[kind] + "/" + key,
 		Version: version,
+		id:      id,
 	}
 }
 
-func makeFlagsDeleteEvent(key string, version int) es.Event {
+func makeFlagsDeleteEvent(key string, version int, id string) es.Event {
 	return deleteEvent{
 		Path:    "/" + key,
 		Version: version,
+		id:      id,
 	}
 }
 
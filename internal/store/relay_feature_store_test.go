@@ -0,0 +1,82 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	es "github.com/launchdarkly/eventsource"
+	"gopkg.in/launchdarkly/go-server-sdk.v4/ldlog"
+	"gopkg.in/launchdarkly/ld-relay.v5/internal/store/bus"
+)
+
+// fakeEvent is a minimal es.Event for exercising publish logic without a real feature store or
+// eventsource.Server behind it.
+type fakeEvent struct {
+	event string
+	data  string
+}
+
+func (e fakeEvent) Id() string      { return "" }
+func (e fakeEvent) Event() string   { return e.event }
+func (e fakeEvent) Data() string    { return e.data }
+func (e fakeEvent) Comment() string { return "" }
+
+// fakePublisher is an ESPublisher that records every Publish call's channel list, in order, so
+// tests can assert on publish ordering without a real eventsource.Server.
+type fakePublisher struct {
+	published [][]string
+}
+
+func (p *fakePublisher) Publish(channels []string, event es.Event) {
+	p.published = append(p.published, append([]string(nil), channels...))
+}
+
+func (p *fakePublisher) PublishComment(channels []string, text string) {}
+
+func (p *fakePublisher) Register(channel string, repo es.Repository) {}
+
+func (p *fakePublisher) SubscriberCount(channel string) int { return 0 }
+
+// TestPublishEventOrdersOverlappingChannels verifies that a single item update publishes to
+// every channel it overlaps with (its own environment, its project, and its tags) in the same,
+// stable order every time. Downstream consumers of the bus.EventSink fan-out, and anyone
+// comparing successive publishes, depend on that ordering being deterministic rather than an
+// artifact of map iteration.
+func TestPublishEventOrdersOverlappingChannels(t *testing.T) {
+	registry := NewChannelRegistry()
+	registry.Register(ChannelSpec{EnvID: "sdk-key", ProjectID: "proj1", Tags: []string{"tag-a", "tag-b"}})
+
+	wantChannels := registry.Channels("sdk-key")
+	if len(wantChannels) != 4 {
+		t.Fatalf("expected 4 overlapping channels (env, project, 2 tags), got %v", wantChannels)
+	}
+	wantCEChannels := make([]string, len(wantChannels))
+	for i, channel := range wantChannels {
+		wantCEChannels[i] = CloudEventsChannel(channel)
+	}
+
+	publisher := &fakePublisher{}
+	relay := &SSERelayFeatureStore{
+		apiKey:            "sdk-key",
+		cloudEventsSource: "test-source",
+		registry:          registry,
+		dispatcher:        bus.NewDispatcher(nil, 0, ldlog.Loggers{}),
+	}
+
+	const publishes = 3
+	for i := 0; i < publishes; i++ {
+		relay.publishEvent(publisher, sdkKindFlags, fakeEvent{event: "patch", data: "{}"}, ceTypeFlagPatch, "/flag-a")
+	}
+
+	if len(publisher.published) != publishes*2 {
+		t.Fatalf("expected %d Publish calls (plain + CloudEvents per update), got %d", publishes*2, len(publisher.published))
+	}
+	for i := 0; i < publishes; i++ {
+		if got := publisher.published[i*2]; !reflect.DeepEqual(got, wantChannels) {
+			t.Errorf("update %d: plain channel order = %v, want %v", i, got, wantChannels)
+		}
+		if got := publisher.published[i*2+1]; !reflect.DeepEqual(got, wantCEChannels) {
+			t.Errorf("update %d: CloudEvents channel order = %v, want %v", i, got, wantCEChannels)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"sync"
+
+	es "github.com/launchdarkly/eventsource"
+)
+
+// DefaultReplayBufferSize is the number of patch/delete events retained per
+// channel when no buffer size is configured.
+const DefaultReplayBufferSize = 100
+
+type replayBufferEntry struct {
+	id    uint64
+	event es.Event
+}
+
+// ReplayBuffer keeps a bounded, per-channel history of recent patch/delete
+// events so a reconnecting SSE client that sends a Last-Event-ID can be
+// replayed just the deltas it missed instead of a full put snapshot. Each
+// channel's history is a FIFO ring: once it holds size entries, adding
+// another evicts the oldest. Memory use is therefore bounded by
+// size * (number of channels) * (typical patch/delete event size) - with the
+// default size of 100 and a handful of channels, this is a few hundred KB at
+// most even for large flag payloads.
+type ReplayBuffer struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string][]replayBufferEntry
+}
+
+// NewReplayBuffer creates a ReplayBuffer that retains at most size events
+// per channel. A non-positive size falls back to DefaultReplayBufferSize.
+func NewReplayBuffer(size int) *ReplayBuffer {
+	if size <= 0 {
+		size = DefaultReplayBufferSize
+	}
+	return &ReplayBuffer{size: size, entries: make(map[string][]replayBufferEntry)}
+}
+
+// Add appends event under id to channel's history, evicting the oldest
+// entry first if the channel's buffer is already full.
+func (b *ReplayBuffer) Add(channel string, id uint64, event es.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := append(b.entries[channel], replayBufferEntry{id: id, event: event})
+	if len(entries) > b.size {
+		entries = entries[len(entries)-b.size:]
+	}
+	b.entries[channel] = entries
+}
+
+// Since returns every buffered event on channel with an id greater than
+// lastID, oldest first, along with whether the buffer could satisfy the
+// request. It returns ok=false when the channel has no history, when events
+// after lastID have already been evicted (lastID is more than one below the
+// oldest retained id), or when lastID is newer than the newest retained id
+// (it was never seen) - callers should fall back to a full put snapshot in
+// that case.
+func (b *ReplayBuffer) Since(channel string, lastID uint64) (events []es.Event, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := b.entries[channel]
+	if len(entries) == 0 || lastID < entries[0].id-1 || lastID > entries[len(entries)-1].id {
+		return nil, false
+	}
+
+	for _, entry := range entries {
+		if entry.id > lastID {
+			events = append(events, entry.event)
+		}
+	}
+	return events, true
+}
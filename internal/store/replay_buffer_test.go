@@ -0,0 +1,55 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	es "github.com/launchdarkly/eventsource"
+)
+
+func dataOf(events []es.Event) []string {
+	out := make([]string, len(events))
+	for i, event := range events {
+		out[i] = event.Data()
+	}
+	return out
+}
+
+// TestReplayBufferSinceBoundary covers the fallback-to-full-snapshot boundary in
+// ReplayBuffer.Since: once a channel's history has evicted past a client's Last-Event-ID, that
+// client must fall back to a full put rather than receive a gap in its delta replay.
+func TestReplayBufferSinceBoundary(t *testing.T) {
+	buf := NewReplayBuffer(3)
+	const channel = "flags:env1"
+
+	for id := uint64(1); id <= 5; id++ {
+		buf.Add(channel, id, fakeEvent{event: "patch", data: fmt.Sprintf("event-%d", id)})
+	}
+	// size 3 means only ids 3, 4, 5 remain buffered; id 2 was the most recently evicted.
+
+	if events, ok := buf.Since(channel, 1); ok {
+		t.Errorf("Since(1) = (%v, true), want ok=false: id 2 was evicted and would be missing from the delta", dataOf(events))
+	}
+
+	events, ok := buf.Since(channel, 2)
+	if !ok {
+		t.Fatalf("Since(2) = not ok, want ok: every event since the evicted tail id is still buffered")
+	}
+	if want := []string{"event-3", "event-4", "event-5"}; !reflect.DeepEqual(dataOf(events), want) {
+		t.Errorf("Since(2) = %v, want %v", dataOf(events), want)
+	}
+
+	events, ok = buf.Since(channel, 4)
+	if want := []string{"event-5"}; !ok || !reflect.DeepEqual(dataOf(events), want) {
+		t.Errorf("Since(4) = (%v, %v), want (%v, true)", dataOf(events), ok, want)
+	}
+
+	if events, ok := buf.Since(channel, 5); !ok || len(events) != 0 {
+		t.Errorf("Since(5) = (%v, %v), want (empty, true): caller is already fully caught up", dataOf(events), ok)
+	}
+
+	if _, ok := buf.Since("unknown-channel", 0); ok {
+		t.Errorf("Since on a channel with no history = ok, want false")
+	}
+}